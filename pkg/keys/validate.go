@@ -0,0 +1,251 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package keys
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/pkg/errors"
+)
+
+// KeyKind identifies the category of key a caller expects to see, so that
+// Validate can check the key's shape without the caller re-implementing the
+// decoding logic itself.
+type KeyKind int
+
+const (
+	// KeyKindTenant expects key to be prefixed by the generator's tenant
+	// prefix.
+	KeyKindTenant KeyKind = iota
+	// KeyKindTable expects key to be prefixed by a table ID.
+	KeyKindTable
+	// KeyKindIndex expects key to be prefixed by a table ID followed by an
+	// index ID.
+	KeyKindIndex
+)
+
+// ProblemReason is a typed reason code describing why a key failed
+// validation, analogous to the reason codes surfaced by
+// `debug doctor zipdir` for descriptor problems.
+type ProblemReason int
+
+const (
+	// ReasonWrongTenantPrefix indicates that a key's tenant prefix decodes
+	// to a tenant other than the one the validating generator was
+	// constructed for -- a sign of cross-tenant key leakage.
+	ReasonWrongTenantPrefix ProblemReason = iota
+	// ReasonUnknownTable indicates that a key's table ID doesn't resolve to
+	// a descriptor via the caller-supplied lookup function.
+	ReasonUnknownTable
+	// ReasonOrphanedIndexRow indicates that a key's index ID doesn't belong
+	// to the table descriptor it was decoded against, e.g. because the
+	// index was since dropped.
+	ReasonOrphanedIndexRow
+	// ReasonMalformedKey indicates that the key could not be fully decoded,
+	// e.g. a truncated or corrupt varint segment.
+	ReasonMalformedKey
+)
+
+// String implements fmt.Stringer.
+func (r ProblemReason) String() string {
+	switch r {
+	case ReasonWrongTenantPrefix:
+		return "wrong-tenant-prefix"
+	case ReasonUnknownTable:
+		return "referenced-descriptor-not-found"
+	case ReasonOrphanedIndexRow:
+		return "orphaned-index-row"
+	case ReasonMalformedKey:
+		return "malformed-key"
+	default:
+		return fmt.Sprintf("unknown-reason(%d)", int(r))
+	}
+}
+
+// KeyProblem describes a single issue found while validating a key, carrying
+// enough decoded context for a caller (e.g. `cockroach debug`) to report it
+// without re-decoding the key itself.
+type KeyProblem struct {
+	// Key is the offending key, as found.
+	Key roachpb.Key
+	// TenantID is the tenant ID decoded from Key, if any could be decoded.
+	TenantID roachpb.TenantID
+	// TableID is the table ID decoded from Key, if any could be decoded.
+	TableID uint32
+	// IndexID is the index ID decoded from Key, if any could be decoded.
+	IndexID uint32
+	// Reason is the typed reason this key was flagged.
+	Reason ProblemReason
+	// Detail is a human-readable elaboration of Reason.
+	Detail string
+}
+
+// String implements fmt.Stringer.
+func (p KeyProblem) String() string {
+	return fmt.Sprintf("%s: %s (tenant=%s table=%d index=%d): %s",
+		p.Key, p.Reason, p.TenantID, p.TableID, p.IndexID, p.Detail)
+}
+
+// Descriptor is the minimal surface ValidateRange needs from a descriptor in
+// order to audit a key's index ID against it. It's intentionally narrow so
+// that this package doesn't need to import sql/catalog.
+type Descriptor interface {
+	// GetID returns the descriptor's ID.
+	GetID() uint32
+	// HasPublicIndex returns whether the descriptor has a (non-dropped)
+	// index with the given ID.
+	HasPublicIndex(indexID uint32) bool
+}
+
+// Validate checks that key conforms to the expected KeyKind for the tenant
+// this generator was constructed for. It's a fast, allocation-light check
+// meant to catch cross-tenant key leakage: a key whose leading byte marks it
+// as tenant-prefixed but whose tenant ID doesn't match this generator's is
+// always rejected, regardless of the requested KeyKind.
+func (g TenantIDKeyGen) Validate(key roachpb.Key, expected KeyKind) error {
+	if len(key) > 0 && key[0] == tenantPrefixByte {
+		_, tenID, err := DecodeTenantPrefix(key)
+		if err != nil {
+			return errors.Wrapf(err, "malformed tenant prefix: %q", key)
+		}
+		if wantTenID := g.tenantID(); tenID != wantTenID {
+			return errors.Errorf(
+				"%s: %s: key belongs to tenant %s, expected %s", ReasonWrongTenantPrefix, key, tenID, wantTenID)
+		}
+	}
+
+	switch expected {
+	case KeyKindTenant:
+		if _, err := g.StripTenantPrefix(key); err != nil {
+			return errors.Wrapf(err, "%s", ReasonMalformedKey)
+		}
+	case KeyKindTable:
+		if _, _, err := g.DecodeTablePrefix(key); err != nil {
+			return errors.Wrapf(err, "%s", ReasonMalformedKey)
+		}
+	case KeyKindIndex:
+		if _, _, _, err := g.DecodeIndexPrefix(key); err != nil {
+			return errors.Wrapf(err, "%s", ReasonMalformedKey)
+		}
+	default:
+		return errors.Errorf("unknown key kind: %d", int(expected))
+	}
+	return nil
+}
+
+// tenantID recovers the tenant ID this generator was constructed for, by
+// decoding its own prefix.
+func (g TenantIDKeyGen) tenantID() roachpb.TenantID {
+	_, tenID, err := DecodeTenantPrefix(g.TenantPrefix())
+	if err != nil {
+		// MakeTenantIDKeyGen only ever constructs well-formed prefixes.
+		panic(errors.Wrap(err, "decoding our own tenant prefix"))
+	}
+	return tenID
+}
+
+// ValidateRange audits the [start, end) boundary keys of a range a caller is
+// scanning, reporting a KeyProblem for each issue found. Because this
+// package sits below the storage layer and has no engine access of its own,
+// ValidateRange doesn't iterate the data between start and end itself --
+// callers (e.g. `cockroach debug doctor`, or integration tests walking their
+// own iterator) invoke it once per emitted key, passing that key as both
+// start and end, or once per contiguous chunk to additionally flag
+// cross-tenant straddling. descLookup resolves a decoded table ID to its
+// descriptor, analogous to the descriptor cache `debug doctor zipdir` uses
+// to report referenced-descriptor-not-found problems.
+func (g TenantIDKeyGen) ValidateRange(
+	start, end roachpb.Key, descLookup func(uint32) (Descriptor, bool),
+) []KeyProblem {
+	var problems []KeyProblem
+	boundaries := []roachpb.Key{start}
+	if !start.Equal(end) {
+		boundaries = append(boundaries, end)
+	}
+	for _, key := range boundaries {
+		if len(key) == 0 {
+			continue
+		}
+		problems = append(problems, g.validateKey(key, descLookup)...)
+	}
+
+	if len(start) > 0 && len(end) > 0 {
+		if _, startTenID, err := DecodeTenantPrefix(start); err == nil {
+			if _, endTenID, err := DecodeTenantPrefix(end); err == nil && startTenID != endTenID {
+				problems = append(problems, KeyProblem{
+					Key:      start,
+					TenantID: startTenID,
+					Reason:   ReasonWrongTenantPrefix,
+					Detail:   fmt.Sprintf("range straddles tenants %s and %s", startTenID, endTenID),
+				})
+			}
+		}
+	}
+	return problems
+}
+
+// validateKey decodes a single key as far as it can, reporting any problems
+// found along the way.
+func (g TenantIDKeyGen) validateKey(
+	key roachpb.Key, descLookup func(uint32) (Descriptor, bool),
+) []KeyProblem {
+	var problems []KeyProblem
+	var tenID roachpb.TenantID
+
+	if key[0] == tenantPrefixByte {
+		var err error
+		_, tenID, err = DecodeTenantPrefix(key)
+		if err != nil {
+			return append(problems, KeyProblem{
+				Key: key, Reason: ReasonMalformedKey, Detail: err.Error(),
+			})
+		}
+		if wantTenID := g.tenantID(); tenID != wantTenID {
+			problems = append(problems, KeyProblem{
+				Key: key, TenantID: tenID, Reason: ReasonWrongTenantPrefix,
+				Detail: fmt.Sprintf("expected tenant %s", wantTenID),
+			})
+		}
+	}
+
+	rem, tableID, err := g.DecodeTablePrefix(key)
+	if err != nil {
+		// Not a table-prefixed key (e.g. a bare tenant prefix); nothing
+		// further to check.
+		return problems
+	}
+
+	desc, ok := descLookup(tableID)
+	if !ok {
+		return append(problems, KeyProblem{
+			Key: key, TenantID: tenID, TableID: tableID, Reason: ReasonUnknownTable,
+			Detail: fmt.Sprintf("table %d not found via descLookup", tableID),
+		})
+	}
+
+	if len(rem) == 0 {
+		return problems
+	}
+	_, _, indexID, err := g.DecodeIndexPrefix(key)
+	if err != nil {
+		return append(problems, KeyProblem{
+			Key: key, TenantID: tenID, TableID: tableID, Reason: ReasonMalformedKey, Detail: err.Error(),
+		})
+	}
+	if !desc.HasPublicIndex(indexID) {
+		problems = append(problems, KeyProblem{
+			Key: key, TenantID: tenID, TableID: tableID, IndexID: indexID, Reason: ReasonOrphanedIndexRow,
+			Detail: fmt.Sprintf("index %d not found on table %d", indexID, tableID),
+		})
+	}
+	return problems
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package keys
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDescriptor struct {
+	id      uint32
+	indexes map[uint32]bool
+}
+
+func (d fakeDescriptor) GetID() uint32 { return d.id }
+func (d fakeDescriptor) HasPublicIndex(indexID uint32) bool {
+	return d.indexes[indexID]
+}
+
+func TestTenantIDKeyGenValidate(t *testing.T) {
+	gen := MakeTenantIDKeyGen(roachpb.MustMakeTenantID(5))
+	other := MakeTenantIDKeyGen(roachpb.MustMakeTenantID(6))
+
+	t.Run("accepts own tenant prefix", func(t *testing.T) {
+		require.NoError(t, gen.Validate(gen.TenantPrefix(), KeyKindTenant))
+	})
+
+	t.Run("rejects foreign tenant prefix", func(t *testing.T) {
+		require.Error(t, gen.Validate(other.TenantPrefix(), KeyKindTenant))
+	})
+
+	t.Run("accepts own table prefix", func(t *testing.T) {
+		require.NoError(t, gen.Validate(gen.TablePrefix(50), KeyKindTable))
+	})
+
+	t.Run("rejects malformed index prefix", func(t *testing.T) {
+		require.Error(t, gen.Validate(gen.TablePrefix(50), KeyKindIndex))
+	})
+}
+
+func TestTenantIDKeyGenValidateRange(t *testing.T) {
+	gen := MakeTenantIDKeyGen(roachpb.MustMakeTenantID(5))
+	descs := map[uint32]fakeDescriptor{
+		50: {id: 50, indexes: map[uint32]bool{1: true}},
+	}
+	lookup := func(id uint32) (Descriptor, bool) {
+		d, ok := descs[id]
+		return d, ok
+	}
+
+	t.Run("no problems for a healthy index row", func(t *testing.T) {
+		key := gen.IndexPrefix(50, 1)
+		require.Empty(t, gen.ValidateRange(key, key, lookup))
+	})
+
+	t.Run("flags unknown table", func(t *testing.T) {
+		key := gen.TablePrefix(99)
+		problems := gen.ValidateRange(key, key, lookup)
+		require.Len(t, problems, 1)
+		require.Equal(t, ReasonUnknownTable, problems[0].Reason)
+		require.Equal(t, uint32(99), problems[0].TableID)
+	})
+
+	t.Run("flags orphaned index row", func(t *testing.T) {
+		key := gen.IndexPrefix(50, 2)
+		problems := gen.ValidateRange(key, key, lookup)
+		require.Len(t, problems, 1)
+		require.Equal(t, ReasonOrphanedIndexRow, problems[0].Reason)
+		require.Equal(t, uint32(2), problems[0].IndexID)
+	})
+
+	t.Run("flags cross-tenant straddling range", func(t *testing.T) {
+		otherGen := MakeTenantIDKeyGen(roachpb.MustMakeTenantID(6))
+		problems := gen.ValidateRange(gen.TablePrefix(50), otherGen.TablePrefix(50), lookup)
+		require.NotEmpty(t, problems)
+		found := false
+		for _, p := range problems {
+			if p.Reason == ReasonWrongTenantPrefix {
+				found = true
+			}
+		}
+		require.True(t, found)
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package kvflowcontrol provides flow control for replication traffic. It's
+// based on the entrance of the MVCC keyspace into a range's raft log, and
+// paces the raft proposals below-raft so as to not overwhelm slower
+// followers. See the sub-packages for the concrete implementations of the
+// types declared here.
+package kvflowcontrol
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/kv/kvserver/kvflowcontrol/kvflowcontrolpb"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/admission/admissionpb"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+)
+
+// Enabled determines whether we use flow control for replication traffic in
+// KV.
+var Enabled = settings.RegisterBoolSetting(
+	settings.SystemOnly,
+	"kvadmission.flow_control.enabled",
+	"determines whether we use flow control for replication traffic in KV",
+	true,
+)
+
+// ModeT represents the flow control mode, which determines the granularity
+// at which we throttle raft proposals.
+type ModeT int64
+
+const (
+	// ApplyToElastic only applies flow control to elastic (BulkNormalPri and
+	// below) work.
+	ApplyToElastic ModeT = iota
+	// ApplyToAll applies flow control to all work.
+	ApplyToAll
+)
+
+// String implements fmt.Stringer.
+func (m ModeT) String() string {
+	switch m {
+	case ApplyToElastic:
+		return "apply_to_elastic"
+	case ApplyToAll:
+		return "apply_to_all"
+	default:
+		panic(fmt.Sprintf("unknown mode: %v", int64(m)))
+	}
+}
+
+// Mode determines the flow control mode -- whether it's applied to only
+// elastic work, or to all replication work.
+var Mode = settings.RegisterEnumSetting(
+	settings.SystemOnly,
+	"kvadmission.flow_control.mode",
+	"determines how flow control is applied to replication traffic",
+	ApplyToElastic.String(),
+	map[int64]string{
+		int64(ApplyToElastic): ApplyToElastic.String(),
+		int64(ApplyToAll):     ApplyToAll.String(),
+	},
+)
+
+// TenantTokenPoolFraction controls how large a single tenant's flow token
+// pool is allowed to grow, as a fraction of the global pool shared by every
+// tenant on the store. It exists to prevent a single noisy tenant from
+// draining the shared pool and stalling every other tenant's raft proposals.
+// It has no effect on the system tenant, whose per-tenant pool is never
+// capped.
+var TenantTokenPoolFraction = settings.RegisterFloatSetting(
+	settings.SystemOnly,
+	"kvadmission.flow_controller.tenant_token_pool_fraction",
+	"the fraction of the global flow token pool a single non-system tenant "+
+		"is allowed to hold at once",
+	0.5,
+	settings.FloatInRange(0, 1),
+)
+
+// Tokens represent the finite capacity of a given stream, expressed in
+// bytes for data above raft and in log position deltas below it.
+type Tokens int64
+
+// String implements fmt.Stringer.
+func (t Tokens) String() string {
+	return humanizeutil.IBytes(int64(t))
+}
+
+// Stream is a stream along which we replicate data traffic, and for which
+// we maintain flow control state. Concretely, this is the suffix of a range
+// replica's address, identified also by the tenant it belongs to (since a
+// single store can be home to replicas from multiple tenants).
+type Stream struct {
+	TenantID roachpb.TenantID
+	StoreID  roachpb.StoreID
+}
+
+// String implements fmt.Stringer.
+func (s Stream) String() string {
+	return fmt.Sprintf("t%s/s%s", s.TenantID, s.StoreID)
+}
+
+// Handle is used to interface with replication flow control; it's typically
+// held on ranges initiating replication traffic. Handle is associated with a
+// single range at a point in time and is held by the replica instantiating
+// it.
+type Handle interface {
+	// Admit seeks admission to replicate a proposal of a given priority,
+	// regarding the specific work deadline. Requests are queued in priority
+	// order, and is admitted once enough flow tokens are available for the
+	// connected streams. If the deadline elapses before then, an error is
+	// returned.
+	Admit(context.Context, admissionpb.WorkPriority, time.Time) error
+	// DeductTokensFor deducts (without blocking) flow tokens for given
+	// priority work, for the specific raft log position it's destined for.
+	// Requests are assumed to have been deemed admissible first (i.e.
+	// following Admit()).
+	DeductTokensFor(context.Context, admissionpb.WorkPriority, kvflowcontrolpb.RaftLogPosition, Tokens)
+	// ReturnTokensUpto returns all previously deducted tokens for the given
+	// priority for all log positions less than or equal to the given one,
+	// for the given stream. Once returned, subsequent attempts to return the
+	// same tokens are a no-op.
+	ReturnTokensUpto(context.Context, admissionpb.WorkPriority, kvflowcontrolpb.RaftLogPosition, Stream)
+	// ConnectStream connects a stream the handle is responsible for. It's
+	// used to demarcate points in a log past which we no longer expect to
+	// have to return flow tokens (typically used right after a split/merge).
+	ConnectStream(context.Context, kvflowcontrolpb.RaftLogPosition, Stream)
+	// DisconnectStream disconnects a stream the handle is no longer
+	// responsible for. All outstanding tokens for the stream are released.
+	DisconnectStream(context.Context, Stream)
+	// ResetStreams disconnects all streams the handle is responsible for,
+	// releasing all held tokens in the process.
+	ResetStreams(context.Context)
+	// Close closes the handle, releasing all held tokens.
+	Close(context.Context)
+}
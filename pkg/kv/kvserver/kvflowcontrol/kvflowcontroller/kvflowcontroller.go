@@ -0,0 +1,387 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package kvflowcontroller is the integration point for the centralized
+// flow token accounting shared by every kvflowhandle.Handle on a store. It
+// maintains the regular/elastic token pools that individual handles draw
+// from and return tokens to.
+package kvflowcontroller
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/kv/kvserver/kvflowcontrol"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/admission/admissionpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// RegularTokensPerStream is the maximum number of regular flow tokens
+// available for a given stream, shared by every tenant on the store.
+const RegularTokensPerStream kvflowcontrol.Tokens = 16 << 20 // 16 MiB
+
+// ElasticTokensPerStream is the maximum number of elastic flow tokens
+// available for a given stream, shared by every tenant on the store.
+// Regular work also deducts from (and returns to) this pool -- it's a
+// subset of the regular token pool, used to rate limit elastic traffic more
+// aggressively than regular traffic.
+const ElasticTokensPerStream kvflowcontrol.Tokens = 8 << 20 // 8 MiB
+
+// Controller is the centralized flow token accounting for all streams on a
+// given store, shared by every kvflowhandle.Handle. It maintains both the
+// global token pools (shared across all tenants) as well as a per-tenant
+// pool sized as a fraction of the global one, so that a single tenant can't
+// exhaust the tokens available to every other tenant's replicas.
+type Controller struct {
+	st    *cluster.Settings
+	clock *hlc.Clock
+
+	mu struct {
+		syncutil.Mutex
+		global [admissionpb.NumWorkClasses]*bucket
+		tenant map[roachpb.TenantID]*tenantBuckets
+	}
+}
+
+type tenantBuckets struct {
+	buckets [admissionpb.NumWorkClasses]*bucket
+}
+
+// bucket is a single token bucket, optionally capped at some limit. A limit
+// of 0 means the bucket is uncapped (used for the system tenant, which is
+// never subject to the per-tenant pool fraction).
+type bucket struct {
+	mu struct {
+		syncutil.Mutex
+		tokens   kvflowcontrol.Tokens
+		signalCh chan struct{}
+		seq      uint64
+		waiters  []*waiter
+	}
+	limit kvflowcontrol.Tokens
+}
+
+// waiter represents a blocked Admit() call registered against a bucket, used
+// to implement priority preemption: a burst of low-priority waiters
+// shouldn't be able to starve out a higher-priority one that arrives later.
+type waiter struct {
+	pri  admissionpb.WorkPriority
+	seq  uint64
+	wake chan struct{}
+}
+
+func newBucket(limit kvflowcontrol.Tokens) *bucket {
+	b := &bucket{limit: limit}
+	b.mu.tokens = limit
+	b.mu.signalCh = make(chan struct{})
+	return b
+}
+
+func (b *bucket) tokensAvailable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit == 0 || b.mu.tokens > 0
+}
+
+func (b *bucket) signal() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.mu.signalCh
+}
+
+func (b *bucket) deduct(tokens kvflowcontrol.Tokens) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mu.tokens -= tokens
+}
+
+func (b *bucket) returnTokens(tokens kvflowcontrol.Tokens) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mu.tokens += tokens
+	b.bumpSignalLocked()
+}
+
+// bumpSignalLocked wakes up every Admit() call currently waiting on this
+// bucket, so it can re-evaluate whether it can proceed. It must be called
+// whenever something that canProceed/tokensAvailable depends on changes --
+// not just token counts, but also queue membership, since a waiter leaving
+// the queue can let the new front-of-queue waiter through.
+func (b *bucket) bumpSignalLocked() {
+	close(b.mu.signalCh)
+	b.mu.signalCh = make(chan struct{})
+}
+
+// register adds a new waiter of the given priority to the bucket's queue. If
+// a lower-priority waiter is already queued, the newest such waiter is woken
+// up so that it can re-queue behind this one -- that's what prevents a burst
+// of low-priority traffic from indefinitely starving out a higher-priority
+// request that arrives in the middle of it.
+func (b *bucket) register(pri admissionpb.WorkPriority) *waiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.mu.seq++
+	w := &waiter{pri: pri, seq: b.mu.seq, wake: make(chan struct{}, 1)}
+
+	var preempt *waiter
+	for _, existing := range b.mu.waiters {
+		if existing.pri < pri && (preempt == nil || existing.seq > preempt.seq) {
+			preempt = existing
+		}
+	}
+	b.mu.waiters = append(b.mu.waiters, w)
+	if preempt != nil {
+		select {
+		case preempt.wake <- struct{}{}:
+		default:
+		}
+	}
+	return w
+}
+
+// unregister removes a waiter from the bucket's queue, typically once its
+// Admit() call has returned. The remaining waiters are woken up so whichever
+// of them is now at the front of the queue can proceed.
+func (b *bucket) unregister(w *waiter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, existing := range b.mu.waiters {
+		if existing == w {
+			b.mu.waiters = append(b.mu.waiters[:i], b.mu.waiters[i+1:]...)
+			b.bumpSignalLocked()
+			break
+		}
+	}
+}
+
+// requeue moves a preempted waiter to the back of its priority class, used
+// after it's been woken up by a higher-priority arrival.
+func (b *bucket) requeue(w *waiter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mu.seq++
+	w.seq = b.mu.seq
+}
+
+// canProceed returns whether w is at the front of the bucket's waiter queue,
+// i.e. whether every other queued waiter is of a strictly lower priority (or
+// the same priority but queued after w). Ties are broken in arrival order.
+func (b *bucket) canProceed(w *waiter) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, other := range b.mu.waiters {
+		if other == w {
+			continue
+		}
+		if other.pri > w.pri || (other.pri == w.pri && other.seq < w.seq) {
+			return false
+		}
+	}
+	return true
+}
+
+// Settings returns the cluster settings the controller was constructed
+// with.
+func (c *Controller) Settings() *cluster.Settings {
+	return c.st
+}
+
+// New sets up a Controller.
+func New(registry *metric.Registry, st *cluster.Settings, clock *hlc.Clock) *Controller {
+	c := &Controller{st: st, clock: clock}
+	c.mu.global[admissionpb.RegularWorkClass] = newBucket(RegularTokensPerStream)
+	c.mu.global[admissionpb.ElasticWorkClass] = newBucket(ElasticTokensPerStream)
+	c.mu.tenant = make(map[roachpb.TenantID]*tenantBuckets)
+	return c
+}
+
+// tenantBucketsLocked returns (creating it if necessary) the per-tenant
+// buckets for the given tenant, sized as a fraction of the global pool. The
+// system tenant gets an uncapped pool -- it's never throttled relative to
+// other tenants.
+func (c *Controller) tenantBucketsLocked(tenantID roachpb.TenantID) *tenantBuckets {
+	if tb, ok := c.mu.tenant[tenantID]; ok {
+		return tb
+	}
+	tb := &tenantBuckets{}
+	if tenantID == roachpb.SystemTenantID {
+		tb.buckets[admissionpb.RegularWorkClass] = newBucket(0)
+		tb.buckets[admissionpb.ElasticWorkClass] = newBucket(0)
+	} else {
+		frac := kvflowcontrol.TenantTokenPoolFraction.Get(&c.st.SV)
+		tb.buckets[admissionpb.RegularWorkClass] = newBucket(
+			kvflowcontrol.Tokens(float64(RegularTokensPerStream) * frac))
+		tb.buckets[admissionpb.ElasticWorkClass] = newBucket(
+			kvflowcontrol.Tokens(float64(ElasticTokensPerStream) * frac))
+	}
+	c.mu.tenant[tenantID] = tb
+	return tb
+}
+
+// classesToDeduct returns the set of work classes that a given priority's
+// work deducts tokens from. Regular work deducts from both the regular and
+// elastic pools (elastic is a subset of regular); elastic work only deducts
+// from the elastic pool.
+func classesToDeduct(wc admissionpb.WorkClass) []admissionpb.WorkClass {
+	if wc == admissionpb.RegularWorkClass {
+		return []admissionpb.WorkClass{admissionpb.RegularWorkClass, admissionpb.ElasticWorkClass}
+	}
+	return []admissionpb.WorkClass{admissionpb.ElasticWorkClass}
+}
+
+// TokensAvailable returns whether flow tokens are available for the given
+// priority and tenant, checking both the global pool and the tenant's own
+// pool.
+func (c *Controller) TokensAvailable(pri admissionpb.WorkPriority, tenantID roachpb.TenantID) bool {
+	return c.GlobalTokensAvailable(pri) && c.TenantTokensAvailable(pri, tenantID)
+}
+
+// GlobalTokensAvailable returns whether flow tokens are available for the
+// given priority in the global pool, shared by every tenant on the store.
+// Priority preemption (see Register) is scoped to this pool: it's the one a
+// burst of low-priority traffic from any tenant can actually contend on.
+func (c *Controller) GlobalTokensAvailable(pri admissionpb.WorkPriority) bool {
+	wc := admissionpb.WorkClassFromPri(pri)
+	for _, class := range classesToDeduct(wc) {
+		if !c.mu.global[class].tokensAvailable() {
+			return false
+		}
+	}
+	return true
+}
+
+// TenantTokensAvailable returns whether flow tokens are available for the
+// given priority in tenantID's own pool.
+func (c *Controller) TenantTokensAvailable(pri admissionpb.WorkPriority, tenantID roachpb.TenantID) bool {
+	wc := admissionpb.WorkClassFromPri(pri)
+	c.mu.Lock()
+	tb := c.tenantBucketsLocked(tenantID)
+	c.mu.Unlock()
+
+	for _, class := range classesToDeduct(wc) {
+		if !tb.buckets[class].tokensAvailable() {
+			return false
+		}
+	}
+	return true
+}
+
+// DeductTokens deducts flow tokens for work with the given priority,
+// deducting from both the global pool and the specific tenant's pool.
+func (c *Controller) DeductTokens(
+	ctx context.Context, pri admissionpb.WorkPriority, tenantID roachpb.TenantID, tokens kvflowcontrol.Tokens,
+) {
+	wc := admissionpb.WorkClassFromPri(pri)
+	c.mu.Lock()
+	tb := c.tenantBucketsLocked(tenantID)
+	c.mu.Unlock()
+
+	for _, class := range classesToDeduct(wc) {
+		c.mu.global[class].deduct(tokens)
+		tb.buckets[class].deduct(tokens)
+	}
+}
+
+// ReturnTokens returns flow tokens previously deducted for work with the
+// given priority, crediting both the global pool and the specific tenant's
+// pool.
+func (c *Controller) ReturnTokens(
+	ctx context.Context, pri admissionpb.WorkPriority, tenantID roachpb.TenantID, tokens kvflowcontrol.Tokens,
+) {
+	wc := admissionpb.WorkClassFromPri(pri)
+	c.mu.Lock()
+	tb := c.tenantBucketsLocked(tenantID)
+	c.mu.Unlock()
+
+	for _, class := range classesToDeduct(wc) {
+		c.mu.global[class].returnTokens(tokens)
+		tb.buckets[class].returnTokens(tokens)
+	}
+}
+
+// contendedClass returns the global bucket that pri would actually block on
+// right now. Elastic work only ever draws from the elastic pool, but regular
+// work draws from both the regular and elastic pools, so it contends on
+// whichever of the two is currently exhausted -- that's the bucket regular
+// and elastic waiters need to share a queue on for preemption to cross
+// between them, as in the case of a BulkNormalPri burst starving out HighPri
+// work by exhausting the elastic pool they both draw from.
+func (c *Controller) contendedClass(pri admissionpb.WorkPriority) admissionpb.WorkClass {
+	wc := admissionpb.WorkClassFromPri(pri)
+	classes := classesToDeduct(wc)
+	class := classes[len(classes)-1]
+	for _, cl := range classes {
+		if !c.mu.global[cl].tokensAvailable() {
+			class = cl
+			break
+		}
+	}
+	return class
+}
+
+// Waiter is a handle to a registered Admit() waiter, used by callers to
+// participate in priority preemption on the bucket they're contending on.
+// It must be unregistered once the corresponding Admit() call returns.
+type Waiter struct {
+	class admissionpb.WorkClass
+	w     *waiter
+}
+
+// Register registers a new waiter for the given priority against the global
+// bucket it would contend on, returning a handle used to track its place in
+// the queue. If a lower-priority waiter is already registered against that
+// same bucket, it's woken up so it can re-queue behind this one.
+func (c *Controller) Register(pri admissionpb.WorkPriority) *Waiter {
+	class := c.contendedClass(pri)
+	return &Waiter{class: class, w: c.mu.global[class].register(pri)}
+}
+
+// Unregister removes a waiter from its bucket's queue.
+func (c *Controller) Unregister(waiter *Waiter) {
+	c.mu.global[waiter.class].unregister(waiter.w)
+}
+
+// Requeue moves a preempted waiter to the back of its priority class.
+func (c *Controller) Requeue(waiter *Waiter) {
+	c.mu.global[waiter.class].requeue(waiter.w)
+}
+
+// CanProceed returns whether the given waiter is at the front of its
+// bucket's queue, i.e. whether it's safe for it to proceed once tokens are
+// available without skipping ahead of a higher-priority waiter.
+func (c *Controller) CanProceed(waiter *Waiter) bool {
+	return c.mu.global[waiter.class].canProceed(waiter.w)
+}
+
+// WakeCh returns the channel a caller should select on to learn that it's
+// been preempted by a higher-priority waiter and should re-queue.
+func (c *Controller) WakeCh(waiter *Waiter) <-chan struct{} {
+	return waiter.w.wake
+}
+
+// WaitChannels returns the signal channels a caller should select on while
+// waiting for tokens to become available for the given priority and tenant.
+// Each channel is closed (and replaced) whenever tokens are returned to the
+// corresponding bucket.
+func (c *Controller) WaitChannels(
+	pri admissionpb.WorkPriority, tenantID roachpb.TenantID,
+) (global, tenant <-chan struct{}) {
+	class := c.contendedClass(pri)
+
+	c.mu.Lock()
+	tb := c.tenantBucketsLocked(tenantID)
+	c.mu.Unlock()
+
+	return c.mu.global[class].signal(), tb.buckets[class].signal()
+}
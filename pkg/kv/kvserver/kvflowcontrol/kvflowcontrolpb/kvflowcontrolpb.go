@@ -0,0 +1,32 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package kvflowcontrolpb hosts the wire-level types shared between the
+// kvflowcontrol packages.
+package kvflowcontrolpb
+
+// RaftLogPosition is a logical position in a raft log. It's used to tie a
+// given quantity of flow tokens to the point in the log they were deducted
+// for, so that the tokens can later be returned once we know the
+// corresponding log entries no longer need them (typically because they've
+// been admitted below-raft, or because the log has been truncated past that
+// point).
+type RaftLogPosition struct {
+	Term  uint64
+	Index uint64
+}
+
+// Less returns true if the receiver sorts before the given position.
+func (p RaftLogPosition) Less(o RaftLogPosition) bool {
+	if p.Term != o.Term {
+		return p.Term < o.Term
+	}
+	return p.Index < o.Index
+}
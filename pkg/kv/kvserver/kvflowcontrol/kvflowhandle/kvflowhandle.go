@@ -0,0 +1,304 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package kvflowhandle provides the canonical implementation for the
+// kvflowcontrol.Handle interface.
+package kvflowhandle
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/kv/kvserver/kvflowcontrol"
+	"github.com/cockroachdb/cockroach/pkg/kv/kvserver/kvflowcontrol/kvflowcontroller"
+	"github.com/cockroachdb/cockroach/pkg/kv/kvserver/kvflowcontrol/kvflowcontrolpb"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/admission/admissionpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/pkg/errors"
+)
+
+// ErrAdmitDeadlineExceeded is returned by Handle.Admit when the caller's
+// admission deadline is reached before flow tokens become available.
+var ErrAdmitDeadlineExceeded = errors.New("admission deadline exceeded waiting for flow tokens")
+
+// deduction records a quantity of tokens deducted for a given priority at a
+// given log position, so that it can later be returned. A single deduction
+// is shared (by pointer) across every stream connected at the time it was
+// made -- tokens are only ever taken out of the global/tenant pools once,
+// so they must only be credited back once too, after every one of those
+// streams has acknowledged it via ReturnTokensUpto (or disconnected).
+type deduction struct {
+	pri     admissionpb.WorkPriority
+	pos     kvflowcontrolpb.RaftLogPosition
+	tokens  kvflowcontrol.Tokens
+	pending map[kvflowcontrol.Stream]struct{}
+}
+
+// ackLocked marks stream as having accounted for this deduction, returning
+// whether every connected stream has now done so (i.e. whether it's safe to
+// actually credit the tokens back to the shared pools).
+func (d *deduction) ackLocked(stream kvflowcontrol.Stream) bool {
+	delete(d.pending, stream)
+	return len(d.pending) == 0
+}
+
+// Handle is the canonical implementation of kvflowcontrol.Handle.
+type Handle struct {
+	controller *kvflowcontroller.Controller
+	metrics    *Metrics
+	clock      *hlc.Clock
+	rangeID    roachpb.RangeID
+	tenantID   roachpb.TenantID
+
+	mu struct {
+		syncutil.Mutex
+		closed     bool
+		signalCh   chan struct{} // closed, and replaced, on connect/disconnect/close/reset
+		deductions map[kvflowcontrol.Stream][]*deduction
+	}
+}
+
+var _ kvflowcontrol.Handle = &Handle{}
+
+// New constructs a new Handle for the given range, backed by the given
+// controller.
+func New(
+	controller *kvflowcontroller.Controller,
+	metrics *Metrics,
+	clock *hlc.Clock,
+	rangeID roachpb.RangeID,
+	tenantID roachpb.TenantID,
+) *Handle {
+	h := &Handle{
+		controller: controller,
+		metrics:    metrics,
+		clock:      clock,
+		rangeID:    rangeID,
+		tenantID:   tenantID,
+	}
+	h.mu.signalCh = make(chan struct{})
+	h.mu.deductions = make(map[kvflowcontrol.Stream][]*deduction)
+	return h
+}
+
+// bumpSignalLocked wakes up every Admit() call currently waiting on this
+// handle, regardless of the stream or priority it's blocked on.
+func (h *Handle) bumpSignalLocked() {
+	close(h.mu.signalCh)
+	h.mu.signalCh = make(chan struct{})
+}
+
+// Admit implements kvflowcontrol.Handle.
+func (h *Handle) Admit(ctx context.Context, pri admissionpb.WorkPriority, deadline time.Time) error {
+	wc := admissionpb.WorkClassFromPri(pri)
+
+	sv := &h.controller.Settings().SV
+	if !kvflowcontrol.Enabled.Get(sv) {
+		return nil
+	}
+	if kvflowcontrol.ModeT(kvflowcontrol.Mode.Get(sv)) == kvflowcontrol.ApplyToElastic &&
+		wc == admissionpb.RegularWorkClass {
+		return nil
+	}
+
+	// An already-elapsed deadline doesn't preempt an immediate admission --
+	// it only needs to fire if we actually end up waiting below, which is
+	// exactly what the deadlineCh case in the select does.
+	var deadlineCh <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(deadline.Sub(h.clock.PhysicalTime()))
+		defer timer.Stop()
+		deadlineCh = timer.C
+	}
+
+	// waiter is only registered against the global pool's priority queue once
+	// we actually need to contend for it -- e.g. a tenant that's blocked
+	// solely on its own exhausted per-tenant pool never joins the global
+	// queue, and so never delays anyone else's admission.
+	var waiter *kvflowcontroller.Waiter
+	defer func() {
+		if waiter != nil {
+			h.controller.Unregister(waiter)
+		}
+	}()
+
+	for {
+		h.mu.Lock()
+		if h.mu.closed || len(h.mu.deductions) == 0 {
+			// Nothing connected (or the handle's been closed/reset); there's
+			// nothing to wait for.
+			h.mu.Unlock()
+			return nil
+		}
+		handleSignalCh := h.mu.signalCh
+		h.mu.Unlock()
+
+		if waiter == nil && !h.controller.GlobalTokensAvailable(pri) {
+			waiter = h.controller.Register(pri)
+		}
+
+		// Latch the channels we'll wait on before re-checking whether we can
+		// proceed: tokens returned between the check below and a stale
+		// channel fetched afterwards would otherwise be a missed wakeup.
+		// Fetching first means a return landing in either window is either
+		// reflected in the check (so we don't wait at all) or closes the
+		// very channel we're about to select on.
+		globalCh, tenantCh := h.controller.WaitChannels(pri, h.tenantID)
+		var wakeCh <-chan struct{}
+		if waiter != nil {
+			wakeCh = h.controller.WakeCh(waiter)
+		}
+
+		if (waiter == nil || h.controller.CanProceed(waiter)) &&
+			h.controller.TokensAvailable(pri, h.tenantID) {
+			return nil
+		}
+
+		select {
+		case <-globalCh:
+		case <-tenantCh:
+		case <-handleSignalCh:
+		case <-wakeCh:
+			// A higher-priority waiter arrived and preempted us; re-queue
+			// behind it and go around again.
+			h.controller.Requeue(waiter)
+		case <-deadlineCh:
+			h.metrics.AdmitDeadlineExceeded.Inc(1)
+			return ErrAdmitDeadlineExceeded
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// DeductTokensFor implements kvflowcontrol.Handle.
+func (h *Handle) DeductTokensFor(
+	ctx context.Context,
+	pri admissionpb.WorkPriority,
+	pos kvflowcontrolpb.RaftLogPosition,
+	tokens kvflowcontrol.Tokens,
+) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.mu.deductions) == 0 {
+		// No stream is connected to hand this deduction to, so nothing will
+		// ever ack it back -- mirror Admit's treatment of this state as
+		// having nothing to account for, instead of deducting tokens that'd
+		// never be returned.
+		return
+	}
+
+	// Tokens are deducted from the shared global/tenant pools exactly once
+	// here, regardless of how many streams are connected; d.pending tracks
+	// which of those streams still owe an ack so ReturnTokensUpto (and
+	// friends) can credit the tokens back exactly once too, rather than once
+	// per connected stream.
+	d := &deduction{pri: pri, pos: pos, tokens: tokens, pending: make(map[kvflowcontrol.Stream]struct{}, len(h.mu.deductions))}
+	for stream := range h.mu.deductions {
+		d.pending[stream] = struct{}{}
+		h.mu.deductions[stream] = append(h.mu.deductions[stream], d)
+	}
+	h.controller.DeductTokens(ctx, pri, h.tenantID, tokens)
+}
+
+// ReturnTokensUpto implements kvflowcontrol.Handle.
+func (h *Handle) ReturnTokensUpto(
+	ctx context.Context,
+	pri admissionpb.WorkPriority,
+	upto kvflowcontrolpb.RaftLogPosition,
+	stream kvflowcontrol.Stream,
+) {
+	h.mu.Lock()
+	deductions, ok := h.mu.deductions[stream]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+
+	var returning kvflowcontrol.Tokens
+	var remaining []*deduction
+	for _, d := range deductions {
+		if d.pri == pri && !upto.Less(d.pos) {
+			if d.ackLocked(stream) {
+				returning += d.tokens
+			}
+			continue
+		}
+		remaining = append(remaining, d)
+	}
+	h.mu.deductions[stream] = remaining
+	h.mu.Unlock()
+
+	if returning > 0 {
+		h.controller.ReturnTokens(ctx, pri, h.tenantID, returning)
+	}
+}
+
+// ConnectStream implements kvflowcontrol.Handle.
+func (h *Handle) ConnectStream(ctx context.Context, pos kvflowcontrolpb.RaftLogPosition, stream kvflowcontrol.Stream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.mu.deductions[stream]; !ok {
+		h.mu.deductions[stream] = nil
+	}
+	h.bumpSignalLocked()
+}
+
+// DisconnectStream implements kvflowcontrol.Handle.
+func (h *Handle) DisconnectStream(ctx context.Context, stream kvflowcontrol.Stream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if deductions, ok := h.mu.deductions[stream]; ok {
+		for _, d := range deductions {
+			if d.ackLocked(stream) {
+				h.controller.ReturnTokens(ctx, d.pri, h.tenantID, d.tokens)
+			}
+		}
+		delete(h.mu.deductions, stream)
+	}
+	h.bumpSignalLocked()
+}
+
+// ResetStreams implements kvflowcontrol.Handle.
+func (h *Handle) ResetStreams(ctx context.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for stream, deductions := range h.mu.deductions {
+		for _, d := range deductions {
+			if d.ackLocked(stream) {
+				h.controller.ReturnTokens(ctx, d.pri, h.tenantID, d.tokens)
+			}
+		}
+		delete(h.mu.deductions, stream)
+	}
+	h.bumpSignalLocked()
+}
+
+// Close implements kvflowcontrol.Handle.
+func (h *Handle) Close(ctx context.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.mu.closed {
+		return
+	}
+	for stream, deductions := range h.mu.deductions {
+		for _, d := range deductions {
+			if d.ackLocked(stream) {
+				h.controller.ReturnTokens(ctx, d.pri, h.tenantID, d.tokens)
+			}
+		}
+		delete(h.mu.deductions, stream)
+	}
+	h.mu.closed = true
+	h.bumpSignalLocked()
+}
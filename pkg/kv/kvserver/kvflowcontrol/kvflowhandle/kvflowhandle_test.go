@@ -33,7 +33,15 @@ import (
 // - we block until there are flow tokens available;
 // - we unblock when streams without flow tokens are disconnected;
 // - we unblock when the handle is closed;
-// - we unblock when the handle is reset.
+// - we unblock when the handle is reset;
+// - a deduction made while multiple streams are connected is only
+// credited back once every one of them has acknowledged it;
+// - a tenant exhausting its own per-tenant pool doesn't block other
+// tenants drawing on the shared global pool;
+// - a caller's admission deadline is honored, but doesn't preempt an
+// admission that wouldn't have had to wait at all;
+// - a higher-priority waiter preempts a burst of lower-priority ones so it
+// isn't starved out.
 func TestHandleAdmit(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
@@ -123,6 +131,256 @@ func TestHandleAdmit(t *testing.T) {
 			}
 		})
 	}
+
+	// multi-stream-deduction tests that a deduction made while multiple
+	// streams are connected to the same handle is only credited back to
+	// the shared pools once every one of those streams has acknowledged
+	// it -- not once per stream, which would over-credit the pool.
+	t.Run("multi-stream-deduction", func(t *testing.T) {
+		streamX := kvflowcontrol.Stream{TenantID: roachpb.SystemTenantID, StoreID: roachpb.StoreID(1)}
+		streamY := kvflowcontrol.Stream{TenantID: roachpb.SystemTenantID, StoreID: roachpb.StoreID(2)}
+
+		registry := metric.NewRegistry()
+		clock := hlc.NewClockForTesting(nil)
+		st := cluster.MakeTestingClusterSettings()
+		kvflowcontrol.Enabled.Override(ctx, &st.SV, true)
+		kvflowcontrol.Mode.Override(ctx, &st.SV, int64(kvflowcontrol.ApplyToAll))
+
+		controller := kvflowcontroller.New(registry, st, clock)
+		handle := kvflowhandle.New(
+			controller, kvflowhandle.NewMetrics(registry), clock, roachpb.RangeID(1), roachpb.SystemTenantID,
+		)
+		defer handle.Close(ctx)
+
+		// Connect two streams and deplete the full 16MiB regular pool with a
+		// single deduction -- tokens are only ever taken out of the shared
+		// pool once, regardless of how many streams are connected.
+		handle.ConnectStream(ctx, pos(0), streamX)
+		handle.ConnectStream(ctx, pos(0), streamY)
+		handle.DeductTokensFor(ctx, admissionpb.NormalPri, pos(1), kvflowcontrol.Tokens(16<<20 /* 16MiB */))
+
+		// Acking from streamX alone shouldn't credit the pool back yet --
+		// streamY still owes its ack for the same deduction.
+		handle.ReturnTokensUpto(ctx, admissionpb.NormalPri, pos(1), streamX)
+		admitCh := make(chan struct{})
+		go func() {
+			require.NoError(t, handle.Admit(ctx, admissionpb.NormalPri, time.Time{}))
+			close(admitCh)
+		}()
+		select {
+		case <-admitCh:
+			t.Fatalf("unexpectedly admitted before every connected stream acked the deduction")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		// Acking from streamY finally credits the tokens back -- exactly
+		// once, not once per stream.
+		handle.ReturnTokensUpto(ctx, admissionpb.NormalPri, pos(1), streamY)
+		select {
+		case <-admitCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("didn't get admitted after every connected stream acked the deduction")
+		}
+
+		// The pool should be back to exactly its original 16MiB -- not
+		// 32MiB from a double-credit -- so depleting it again in full
+		// should still block a subsequent Admit().
+		handle.DeductTokensFor(ctx, admissionpb.NormalPri, pos(2), kvflowcontrol.Tokens(16<<20 /* 16MiB */))
+		blockedCh := make(chan struct{})
+		go func() {
+			require.NoError(t, handle.Admit(ctx, admissionpb.NormalPri, time.Time{}))
+			close(blockedCh)
+		}()
+		select {
+		case <-blockedCh:
+			t.Fatalf("unexpectedly admitted with the pool re-depleted -- tokens were over-credited earlier")
+		case <-time.After(10 * time.Millisecond):
+		}
+		handle.ReturnTokensUpto(ctx, admissionpb.NormalPri, pos(2), streamX)
+		handle.ReturnTokensUpto(ctx, admissionpb.NormalPri, pos(2), streamY)
+		select {
+		case <-blockedCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("didn't get admitted after the re-depleted pool was fully returned")
+		}
+	})
+
+	// two-tenants tests that per-tenant flow token pools isolate tenants
+	// from one another: a tenant that exhausts its own pool is made to
+	// wait, even while the shared global pool still has tokens to spare for
+	// other tenants.
+	t.Run("two-tenants", func(t *testing.T) {
+		tenantA := roachpb.MustMakeTenantID(10)
+		tenantB := roachpb.MustMakeTenantID(20)
+		streamA := kvflowcontrol.Stream{TenantID: tenantA, StoreID: roachpb.StoreID(1)}
+		streamB := kvflowcontrol.Stream{TenantID: tenantB, StoreID: roachpb.StoreID(1)}
+
+		registry := metric.NewRegistry()
+		clock := hlc.NewClockForTesting(nil)
+		st := cluster.MakeTestingClusterSettings()
+		kvflowcontrol.Enabled.Override(ctx, &st.SV, true)
+		kvflowcontrol.Mode.Override(ctx, &st.SV, int64(kvflowcontrol.ApplyToAll))
+		// Cap each tenant's pool at a quarter of the global pool so tenant A
+		// can exhaust its own cap well before it dents the global pool.
+		kvflowcontrol.TenantTokenPoolFraction.Override(ctx, &st.SV, 0.25)
+
+		controller := kvflowcontroller.New(registry, st, clock)
+		handleA := kvflowhandle.New(
+			controller, kvflowhandle.NewMetrics(registry), clock, roachpb.RangeID(1), tenantA,
+		)
+		handleB := kvflowhandle.New(
+			controller, kvflowhandle.NewMetrics(registry), clock, roachpb.RangeID(2), tenantB,
+		)
+		defer handleA.Close(ctx)
+		defer handleB.Close(ctx)
+
+		handleA.ConnectStream(ctx, pos(0), streamA)
+		handleB.ConnectStream(ctx, pos(0), streamB)
+
+		// Deplete tenant A's regular pool (a quarter of the global 16MiB
+		// pool) without touching the global pool meaningfully.
+		handleA.DeductTokensFor(ctx, admissionpb.NormalPri, pos(1), kvflowcontrol.Tokens(4<<20 /* 4MiB */))
+
+		// Tenant A should now be made to wait on its own exhausted pool...
+		aAdmitCh := make(chan struct{})
+		go func() {
+			require.NoError(t, handleA.Admit(ctx, admissionpb.NormalPri, time.Time{}))
+			close(aAdmitCh)
+		}()
+		select {
+		case <-aAdmitCh:
+			t.Fatalf("tenant A unexpectedly admitted with an exhausted tenant pool")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		// ...while tenant B, with an untouched pool, is admitted
+		// immediately.
+		bAdmitCh := make(chan struct{})
+		go func() {
+			require.NoError(t, handleB.Admit(ctx, admissionpb.NormalPri, time.Time{}))
+			close(bAdmitCh)
+		}()
+		select {
+		case <-bAdmitCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tenant B didn't get admitted despite an untouched tenant pool")
+		}
+
+		// Returning tenant A's tokens unblocks it too.
+		handleA.ReturnTokensUpto(ctx, admissionpb.NormalPri, pos(1), streamA)
+		select {
+		case <-aAdmitCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tenant A didn't get admitted after its tokens were returned")
+		}
+	})
+
+	// deadline tests that Admit respects its admission deadline, returning
+	// ErrAdmitDeadlineExceeded (and bumping the corresponding metric) once
+	// it's reached, instead of blocking indefinitely -- and that it doesn't
+	// preempt an admission that wouldn't have had to wait at all.
+	t.Run("deadline", func(t *testing.T) {
+		registry := metric.NewRegistry()
+		clock := hlc.NewClockForTesting(nil)
+		st := cluster.MakeTestingClusterSettings()
+		kvflowcontrol.Enabled.Override(ctx, &st.SV, true)
+		kvflowcontrol.Mode.Override(ctx, &st.SV, int64(kvflowcontrol.ApplyToAll))
+
+		controller := kvflowcontroller.New(registry, st, clock)
+		metrics := kvflowhandle.NewMetrics(registry)
+		handle := kvflowhandle.New(controller, metrics, clock, roachpb.RangeID(1), roachpb.SystemTenantID)
+		defer handle.Close(ctx)
+
+		handle.ConnectStream(ctx, pos(0), stream)
+		handle.DeductTokensFor(ctx, admissionpb.NormalPri, pos(1), kvflowcontrol.Tokens(16<<20 /* 16MiB */))
+
+		deadline := clock.PhysicalTime().Add(25 * time.Millisecond)
+		start := time.Now()
+		err := handle.Admit(ctx, admissionpb.NormalPri, deadline)
+		elapsed := time.Since(start)
+
+		require.ErrorIs(t, err, kvflowhandle.ErrAdmitDeadlineExceeded)
+		require.GreaterOrEqual(t, elapsed, 20*time.Millisecond, "returned well before the requested deadline")
+		require.LessOrEqual(t, elapsed, 5*time.Second, "took far longer than the requested deadline")
+		require.EqualValues(t, 1, metrics.AdmitDeadlineExceeded.Count())
+
+		// Return the deducted tokens so the pool has capacity again, then
+		// verify that an already-past deadline doesn't preempt an admission
+		// that doesn't need to wait at all.
+		handle.ReturnTokensUpto(ctx, admissionpb.NormalPri, pos(1), stream)
+		require.NoError(t, handle.Admit(ctx, admissionpb.NormalPri, clock.PhysicalTime().Add(-time.Hour)))
+	})
+
+	// priority-preemption tests that a burst of low-priority traffic can't
+	// indefinitely starve out a higher-priority request: once a HighPri
+	// Admit() call arrives at a depleted bucket, it preempts the newest
+	// lower-priority waiter and is admitted first once tokens are returned.
+	t.Run("priority-preemption", func(t *testing.T) {
+		registry := metric.NewRegistry()
+		clock := hlc.NewClockForTesting(nil)
+		st := cluster.MakeTestingClusterSettings()
+		kvflowcontrol.Enabled.Override(ctx, &st.SV, true)
+		kvflowcontrol.Mode.Override(ctx, &st.SV, int64(kvflowcontrol.ApplyToAll))
+
+		controller := kvflowcontroller.New(registry, st, clock)
+		handle := kvflowhandle.New(
+			controller, kvflowhandle.NewMetrics(registry), clock, roachpb.RangeID(1), roachpb.SystemTenantID,
+		)
+		defer handle.Close(ctx)
+
+		handle.ConnectStream(ctx, pos(0), stream)
+		// Deplete the elastic pool (BulkNormalPri deducts only from it).
+		handle.DeductTokensFor(ctx, admissionpb.BulkNormalPri, pos(1), kvflowcontrol.Tokens(8<<20 /* 8MiB */))
+
+		// admitted records, in admission order, which priority got through.
+		admitted := make(chan admissionpb.WorkPriority, 2)
+		bulkStartedCh := make(chan struct{})
+		go func() {
+			close(bulkStartedCh)
+			require.NoError(t, handle.Admit(ctx, admissionpb.BulkNormalPri, time.Time{}))
+			admitted <- admissionpb.BulkNormalPri
+		}()
+		<-bulkStartedCh
+		select {
+		case <-admitted:
+			t.Fatalf("bulk-normal-pri work unexpectedly admitted")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		// A HighPri waiter arrives at the same (depleted) bucket; it should
+		// preempt the BulkNormalPri waiter.
+		highStartedCh := make(chan struct{})
+		go func() {
+			close(highStartedCh)
+			require.NoError(t, handle.Admit(ctx, admissionpb.HighPri, time.Time{}))
+			admitted <- admissionpb.HighPri
+		}()
+		<-highStartedCh
+		select {
+		case <-admitted:
+			t.Fatalf("high-pri work unexpectedly admitted before tokens were returned")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		// Return the deducted tokens. The HighPri waiter, having preempted
+		// the BulkNormalPri one, should be admitted first -- and, since
+		// Admit() doesn't itself deduct anything, the same tokens then free
+		// up the preempted BulkNormalPri waiter right behind it.
+		handle.ReturnTokensUpto(ctx, admissionpb.BulkNormalPri, pos(1), stream)
+
+		select {
+		case pri := <-admitted:
+			require.Equal(t, admissionpb.HighPri, pri, "high-pri work should've been admitted first")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no work was admitted")
+		}
+		select {
+		case pri := <-admitted:
+			require.Equal(t, admissionpb.BulkNormalPri, pri, "bulk-normal-pri work should've been admitted second")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("bulk-normal-pri work never got admitted after being preempted")
+		}
+	})
 }
 
 func TestFlowControlMode(t *testing.T) {
@@ -222,4 +480,68 @@ func TestFlowControlMode(t *testing.T) {
 		})
 	}
 
+	// tenant-pool-isolation tests that, with flow control applied to all
+	// work, a tenant exhausting its own capped pool is made to wait, while
+	// another tenant with an untouched pool is admitted immediately.
+	t.Run("tenant-pool-isolation", func(t *testing.T) {
+		tenantA := roachpb.MustMakeTenantID(10)
+		tenantB := roachpb.MustMakeTenantID(20)
+		streamA := kvflowcontrol.Stream{TenantID: tenantA, StoreID: roachpb.StoreID(1)}
+		streamB := kvflowcontrol.Stream{TenantID: tenantB, StoreID: roachpb.StoreID(1)}
+
+		registry := metric.NewRegistry()
+		clock := hlc.NewClockForTesting(nil)
+		st := cluster.MakeTestingClusterSettings()
+		kvflowcontrol.Enabled.Override(ctx, &st.SV, true)
+		kvflowcontrol.Mode.Override(ctx, &st.SV, int64(kvflowcontrol.ApplyToAll))
+		kvflowcontrol.TenantTokenPoolFraction.Override(ctx, &st.SV, 0.25)
+
+		controller := kvflowcontroller.New(registry, st, clock)
+		handleA := kvflowhandle.New(
+			controller, kvflowhandle.NewMetrics(registry), clock, roachpb.RangeID(1), tenantA,
+		)
+		handleB := kvflowhandle.New(
+			controller, kvflowhandle.NewMetrics(registry), clock, roachpb.RangeID(2), tenantB,
+		)
+		defer handleA.Close(ctx)
+		defer handleB.Close(ctx)
+
+		handleA.ConnectStream(ctx, pos(0), streamA)
+		handleB.ConnectStream(ctx, pos(0), streamB)
+
+		// Deplete tenant A's regular pool (a quarter of the global 16MiB
+		// pool) without touching the global pool meaningfully.
+		handleA.DeductTokensFor(ctx, admissionpb.NormalPri, pos(1), kvflowcontrol.Tokens(4<<20 /* 4MiB */))
+
+		aAdmitCh := make(chan struct{})
+		go func() {
+			require.NoError(t, handleA.Admit(ctx, admissionpb.NormalPri, time.Time{}))
+			close(aAdmitCh)
+		}()
+		select {
+		case <-aAdmitCh:
+			t.Fatalf("tenant A unexpectedly admitted with an exhausted tenant pool")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		select {
+		case <-func() chan struct{} {
+			ch := make(chan struct{})
+			go func() {
+				require.NoError(t, handleB.Admit(ctx, admissionpb.NormalPri, time.Time{}))
+				close(ch)
+			}()
+			return ch
+		}():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tenant B didn't get admitted despite an untouched tenant pool")
+		}
+
+		handleA.ReturnTokensUpto(ctx, admissionpb.NormalPri, pos(1), streamA)
+		select {
+		case <-aAdmitCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tenant A didn't get admitted after its tokens were returned")
+		}
+	})
 }
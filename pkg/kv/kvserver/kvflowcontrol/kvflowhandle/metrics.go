@@ -0,0 +1,39 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package kvflowhandle
+
+import "github.com/cockroachdb/cockroach/pkg/util/metric"
+
+// Metrics is the set of metrics tracked by each Handle, aggregated into the
+// registry they're constructed with.
+type Metrics struct {
+	// AdmitDeadlineExceeded counts the number of Admit() calls that returned
+	// early because their caller-provided deadline was reached before flow
+	// tokens became available.
+	AdmitDeadlineExceeded *metric.Counter
+}
+
+var metaAdmitDeadlineExceeded = metric.Metadata{
+	Name:        "kvadmission.flow_controller.admit_deadline_exceeded",
+	Help:        "Number of Admit() calls that returned early after their deadline was reached",
+	Measurement: "Admit Calls",
+	Unit:        metric.Unit_COUNT,
+}
+
+// NewMetrics constructs a new Metrics, registering it with the given
+// registry.
+func NewMetrics(registry *metric.Registry) *Metrics {
+	m := &Metrics{
+		AdmitDeadlineExceeded: metric.NewCounter(metaAdmitDeadlineExceeded),
+	}
+	registry.AddMetric(m.AdmitDeadlineExceeded)
+	return m
+}